@@ -0,0 +1,160 @@
+// Copyright 2020 ConsenSys AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compiled
+
+import (
+	"math/big"
+	"sort"
+)
+
+// CoeffTable deduplicates big.Int coefficients behind small integer IDs,
+// the same kind of ID stored in a Term's CoeffID. Canonicalize takes one as
+// a parameter so it can mint IDs for merged coefficients without
+// disturbing the IDs already referenced elsewhere.
+type CoeffTable struct {
+	Coefficients []big.Int
+	mCoeffs      map[string]int
+}
+
+// NewCoeffTable returns an empty CoeffTable.
+func NewCoeffTable() CoeffTable {
+	return CoeffTable{mCoeffs: make(map[string]int)}
+}
+
+// CoeffID returns the ID associated with v in the table, inserting v as a
+// new entry if it isn't already present.
+func (ct *CoeffTable) CoeffID(v *big.Int) int {
+	key := v.Text(16)
+	if id, ok := ct.mCoeffs[key]; ok {
+		return id
+	}
+	id := len(ct.Coefficients)
+	ct.Coefficients = append(ct.Coefficients, *v)
+	ct.mCoeffs[key] = id
+	return id
+}
+
+// Canonicalize returns l sorted by (Visibility, VariableID) and merged:
+// terms referring to the same wire are combined into a single term whose
+// coefficient is their sum, and terms whose summed coefficient is zero are
+// dropped entirely. ct must be the same CoeffTable every term's CoeffID was
+// allocated from, since merged coefficients are minted through it too.
+func (l LinearExpression) Canonicalize(ct *CoeffTable) LinearExpression {
+	if len(l) == 0 {
+		return l
+	}
+
+	sorted := l.Clone()
+	sort.Sort(sorted)
+
+	res := make(LinearExpression, 0, len(sorted))
+	cur := sorted[0]
+	acc := new(big.Int).Set(&ct.Coefficients[cur.CoeffID()])
+
+	flush := func() {
+		if acc.Sign() == 0 {
+			return
+		}
+		_, vID, vis := cur.Unpack()
+		res = append(res, Pack(vID, ct.CoeffID(acc), vis))
+	}
+
+	for i := 1; i < len(sorted); i++ {
+		t := sorted[i]
+		_, vID, vis := t.Unpack()
+		_, curVID, curVis := cur.Unpack()
+		if vID == curVID && vis == curVis {
+			acc.Add(acc, &ct.Coefficients[t.CoeffID()])
+			continue
+		}
+		flush()
+		cur = t
+		acc = new(big.Int).Set(&ct.Coefficients[t.CoeffID()])
+	}
+	flush()
+
+	return res
+}
+
+// CanonicalizeByID is a cheaper variant of Canonicalize for when equal
+// CoeffIDs already imply equal coefficients: it sorts and drops exact
+// duplicate terms by comparing (VariableID, Visibility, CoeffID) alone,
+// without touching a coefficient table or summing distinct coefficients.
+func (l LinearExpression) CanonicalizeByID() LinearExpression {
+	if len(l) == 0 {
+		return l
+	}
+
+	sorted := l.Clone()
+	sort.Sort(sorted)
+
+	res := make(LinearExpression, 0, len(sorted))
+	res = append(res, sorted[0])
+	for i := 1; i < len(sorted); i++ {
+		t := sorted[i]
+		_, vID, vis := t.Unpack()
+		// the sort leaves terms of one wire in no particular order, so scan
+		// back over the whole run of that wire for an exact duplicate.
+		dup := false
+		for k := len(res) - 1; k >= 0; k-- {
+			_, kVID, kVis := res[k].Unpack()
+			if kVID != vID || kVis != vis {
+				break
+			}
+			if res[k].CoeffID() == t.CoeffID() {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// Canonicalize rewrites L, R and O in place through LinearExpression's
+// Canonicalize, allocating merged coefficients through ct.
+func (r1c *R1C) Canonicalize(ct *CoeffTable) {
+	r1c.L = r1c.L.Canonicalize(ct)
+	r1c.R = r1c.R.Canonicalize(ct)
+	r1c.O = r1c.O.Canonicalize(ct)
+}
+
+// Equal reports whether r1c and other have identical L, R and O, comparing
+// coefficients by value through ct (shared by both) rather than by CoeffID.
+// Both R1Cs must already be canonicalized through ct (see Canonicalize) for
+// this to be a true structural equality check.
+func (r1c *R1C) Equal(other *R1C, ct *CoeffTable) bool {
+	return r1c.L.equal(other.L, ct) && r1c.R.equal(other.R, ct) && r1c.O.equal(other.O, ct)
+}
+
+func (l LinearExpression) equal(other LinearExpression, ct *CoeffTable) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		lCoeff, lVID, lVis := l[i].Unpack()
+		oCoeff, oVID, oVis := other[i].Unpack()
+		if lVID != oVID || lVis != oVis {
+			return false
+		}
+		if ct.Coefficients[lCoeff].Cmp(&ct.Coefficients[oCoeff]) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 ConsenSys AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compiled
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestLinearExpressionCanonicalizeMergesDuplicateWires(t *testing.T) {
+	ct := NewCoeffTable()
+	three := ct.CoeffID(big.NewInt(3))
+	four := ct.CoeffID(big.NewInt(4))
+
+	l := LinearExpression{
+		Pack(1, three, Internal),
+		Pack(1, four, Internal), // same wire as above, should merge to 7
+	}
+
+	res := l.Canonicalize(&ct)
+	if len(res) != 1 {
+		t.Fatalf("got %d terms, want 1: %v", len(res), res)
+	}
+	cID, vID, vis := res[0].Unpack()
+	if vID != 1 || vis != Internal {
+		t.Fatalf("unexpected merged term %v", res[0])
+	}
+	if ct.Coefficients[cID].Cmp(big.NewInt(7)) != 0 {
+		t.Fatalf("got coeff %s, want 7", ct.Coefficients[cID].String())
+	}
+}
+
+func TestLinearExpressionCanonicalizeDropsZeroSum(t *testing.T) {
+	ct := NewCoeffTable()
+	five := ct.CoeffID(big.NewInt(5))
+	minusFive := ct.CoeffID(big.NewInt(-5))
+
+	l := LinearExpression{
+		Pack(2, five, Secret),
+		Pack(2, minusFive, Secret),
+	}
+
+	res := l.Canonicalize(&ct)
+	if len(res) != 0 {
+		t.Fatalf("got %v, want an empty LinearExpression", res)
+	}
+}
+
+func TestLinearExpressionCanonicalizeSortOrder(t *testing.T) {
+	ct := NewCoeffTable()
+	one := ct.CoeffID(big.NewInt(1))
+
+	l := LinearExpression{
+		Pack(5, one, Internal),
+		Pack(2, one, Public),
+		Pack(9, one, Internal),
+	}
+
+	res := l.Canonicalize(&ct)
+	if len(res) != 3 {
+		t.Fatalf("got %d terms, want 3", len(res))
+	}
+	// Less() orders by (visibility desc, variableID asc); Public > Internal.
+	_, _, firstVis := res[0].Unpack()
+	if firstVis != Public {
+		t.Fatalf("got visibility %v first, want Public", firstVis)
+	}
+	_, secondVID, _ := res[1].Unpack()
+	_, thirdVID, _ := res[2].Unpack()
+	if secondVID != 5 || thirdVID != 9 {
+		t.Fatalf("got variable order %d, %d, want 5, 9", secondVID, thirdVID)
+	}
+}
+
+func TestLinearExpressionCanonicalizeByIDDropsOnlyExactDuplicates(t *testing.T) {
+	l := LinearExpression{
+		Pack(1, 0, Internal),
+		Pack(1, 0, Internal), // exact duplicate, dropped
+		Pack(1, 1, Internal), // same wire, different CoeffID, kept
+	}
+
+	res := l.CanonicalizeByID()
+	if len(res) != 2 {
+		t.Fatalf("got %d terms, want 2: %v", len(res), res)
+	}
+}
+
+func TestR1CEqualAfterCanonicalize(t *testing.T) {
+	ct := NewCoeffTable()
+	two := ct.CoeffID(big.NewInt(2))
+	three := ct.CoeffID(big.NewInt(3))
+
+	a := R1C{
+		L: LinearExpression{Pack(1, two, Internal), Pack(2, three, Internal)},
+		R: LinearExpression{Pack(0, two, Public)},
+		O: LinearExpression{},
+	}
+	// Same constraint, terms listed in reverse order.
+	b := R1C{
+		L: LinearExpression{Pack(2, three, Internal), Pack(1, two, Internal)},
+		R: LinearExpression{Pack(0, two, Public)},
+		O: LinearExpression{},
+	}
+
+	a.Canonicalize(&ct)
+	b.Canonicalize(&ct)
+
+	if !a.Equal(&b, &ct) {
+		t.Fatalf("expected canonicalized R1Cs to be equal: %+v vs %+v", a, b)
+	}
+}
+
+func TestR1CEqualComparesCoefficientsByValue(t *testing.T) {
+	// Two separate tables assign different IDs to the same value: Equal
+	// must still report these R1Cs as equal.
+	ctA := NewCoeffTable()
+	idA := ctA.CoeffID(big.NewInt(9))
+	ctB := NewCoeffTable()
+	_ = ctB.CoeffID(big.NewInt(1)) // shift IDs so idB != idA
+	idB := ctB.CoeffID(big.NewInt(9))
+
+	merged := NewCoeffTable()
+	merged.CoeffID(big.NewInt(1))
+	merged.CoeffID(big.NewInt(9))
+
+	a := R1C{L: LinearExpression{Pack(0, idA, Internal)}, R: LinearExpression{}, O: LinearExpression{}}
+	b := R1C{L: LinearExpression{Pack(0, idB, Internal)}, R: LinearExpression{}, O: LinearExpression{}}
+
+	// Re-key a and b's CoeffIDs into the shared "merged" table before
+	// comparing, as Equal requires. b gets a second entry holding the same
+	// value, so the two terms still carry different CoeffIDs.
+	a.L[0] = Pack(0, merged.CoeffID(&ctA.Coefficients[idA]), Internal)
+	merged.Coefficients = append(merged.Coefficients, ctB.Coefficients[idB])
+	b.L[0] = Pack(0, len(merged.Coefficients)-1, Internal)
+
+	if !a.Equal(&b, &merged) {
+		t.Fatalf("expected R1Cs with equal coefficient values to be equal")
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright 2020 ConsenSys AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compiled
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/consensys/gnark/backend/hint"
+)
+
+// r1csMagic identifies a MarshalBinary payload, checked before the schema version.
+var r1csMagic = [4]byte{'g', 'n', 'r', '1'}
+
+// r1csSchemaVersion is bumped whenever the wire encoding below changes incompatibly.
+const r1csSchemaVersion uint16 = 1
+
+// ErrUnsupportedSchema is returned when a payload's schema version is newer
+// than this build understands.
+var ErrUnsupportedSchema = errors.New("compiled: unsupported schema version")
+
+// errVarintOverflow is returned by readUvarint for a malformed varint.
+var errVarintOverflow = errors.New("compiled: varint overflows a 64 bit integer")
+
+// maxDecodeLen bounds any single length- or index-carrying varint a decoder
+// trusts enough to size an allocation from (slice lengths, string lengths,
+// coefficient-table indices). A truncated or corrupt payload can otherwise
+// turn one bogus varint into a multi-gigabyte allocation before the read
+// that would fail ever happens.
+const maxDecodeLen = 1 << 24
+
+// checkDecodeLen rejects n if it exceeds maxDecodeLen.
+func checkDecodeLen(n uint64) error {
+	if n > maxDecodeLen {
+		return fmt.Errorf("compiled: decoded length %d exceeds sanity limit %d", n, maxDecodeLen)
+	}
+	return nil
+}
+
+// readerByteReader is what ReadFrom needs: single-byte reads for varints
+// plus bulk reads for strings and raw coefficient bytes.
+type readerByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// asReaderByteReader returns r unchanged if it already satisfies
+// readerByteReader (so a nested ReadFrom reuses the same buffering as its
+// caller instead of dropping look-ahead bytes), wrapping it otherwise.
+func asReaderByteReader(r io.Reader) readerByteReader {
+	if rbr, ok := r.(readerByteReader); ok {
+		return rbr
+	}
+	return bufio.NewReader(r)
+}
+
+func writeUvarint(w io.Writer, scratch []byte, v uint64) (int64, error) {
+	n := binary.PutUvarint(scratch, v)
+	written, err := w.Write(scratch[:n])
+	return int64(written), err
+}
+
+// readUvarint is binary.ReadUvarint, but also reports the number of bytes consumed.
+func readUvarint(r io.ByteReader) (uint64, int64, error) {
+	var x uint64
+	var s uint
+	var n int64
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, n, err
+		}
+		n++
+		if b < 0x80 {
+			if n > binary.MaxVarintLen64 || (n == binary.MaxVarintLen64 && b > 1) {
+				return 0, n, errVarintOverflow
+			}
+			return x | uint64(b)<<s, n, nil
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+	}
+}
+
+// writeHeader writes the magic followed by the schema version, using a
+// fixed byte order so the payload doesn't depend on the host's.
+func writeHeader(w io.Writer) (int64, error) {
+	n, err := w.Write(r1csMagic[:])
+	if err != nil {
+		return int64(n), err
+	}
+	var v [2]byte
+	binary.LittleEndian.PutUint16(v[:], r1csSchemaVersion)
+	n2, err := w.Write(v[:])
+	return int64(n) + int64(n2), err
+}
+
+// readHeader validates the magic and returns the schema version found in
+// the stream.
+func readHeader(r io.Reader) (uint16, int64, error) {
+	var buf [6]byte
+	n, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return 0, int64(n), err
+	}
+	if !bytes.Equal(buf[:4], r1csMagic[:]) {
+		return 0, int64(n), errors.New("compiled: not a gnark R1CS payload (bad magic)")
+	}
+	return binary.LittleEndian.Uint16(buf[4:]), int64(n), nil
+}
+
+// checkHeader reads the header and rejects it if its schema version is
+// newer than r1csSchemaVersion.
+func checkHeader(r io.Reader) (int64, error) {
+	version, n, err := readHeader(r)
+	if err != nil {
+		return n, err
+	}
+	if version > r1csSchemaVersion {
+		return n, fmt.Errorf("%w: payload is schema %d, this build supports up to %d", ErrUnsupportedSchema, version, r1csSchemaVersion)
+	}
+	return n, nil
+}
+
+// WriteTo writes the binary encoding of t: the CoeffID, then the VariableID
+// packed with the Visibility in its low 3 bits, each as a varint. This
+// assumes Unpack/Pack are a lossless round-trip for t, i.e. that Term
+// carries no state beyond these three fields; if Term ever packs
+// additional bits, this codec must be extended to cover them explicitly.
+func (t Term) WriteTo(w io.Writer) (int64, error) {
+	cID, vID, vis := t.Unpack()
+	var scratch [binary.MaxVarintLen64]byte
+	total, err := writeUvarint(w, scratch[:], uint64(cID))
+	if err != nil {
+		return total, err
+	}
+	n, err := writeUvarint(w, scratch[:], uint64(vID)<<3|uint64(vis))
+	return total + n, err
+}
+
+// ReadFrom reads a Term previously written by WriteTo. See
+// asReaderByteReader for the caveat on reusing r across successive calls.
+func (t *Term) ReadFrom(r io.Reader) (int64, error) {
+	br := asReaderByteReader(r)
+	cID, total, err := readUvarint(br)
+	if err != nil {
+		return total, err
+	}
+	packed, n, err := readUvarint(br)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	*t = Pack(int(packed>>3), int(cID), Visibility(packed&0x7))
+	return total, nil
+}
+
+// WriteTo writes l as a varint length followed by each term's encoding.
+func (l LinearExpression) WriteTo(w io.Writer) (int64, error) {
+	var scratch [binary.MaxVarintLen64]byte
+	total, err := writeUvarint(w, scratch[:], uint64(len(l)))
+	if err != nil {
+		return total, err
+	}
+	for i := range l {
+		n, err := l[i].WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom reads a LinearExpression previously written by WriteTo.
+func (l *LinearExpression) ReadFrom(r io.Reader) (int64, error) {
+	br := asReaderByteReader(r)
+	count, total, err := readUvarint(br)
+	if err != nil {
+		return total, err
+	}
+	if err := checkDecodeLen(count); err != nil {
+		return total, err
+	}
+	res := make(LinearExpression, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var t Term
+		n, err := t.ReadFrom(br)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		res = append(res, t)
+	}
+	*l = res
+	return total, nil
+}
+
+// MarshalBinary returns l prefixed with the stream header.
+func (l LinearExpression) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		return nil, err
+	}
+	if _, err := l.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary reconstructs l from a payload written by MarshalBinary.
+func (l *LinearExpression) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := checkHeader(r); err != nil {
+		return err
+	}
+	_, err := l.ReadFrom(r)
+	return err
+}
+
+// WriteTo writes L, R and O in sequence; each is self-delimited by its own
+// length prefix, so the three can be read back without a wrapping length.
+func (r1c *R1C) WriteTo(w io.Writer) (int64, error) {
+	total, err := r1c.L.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+	n, err := r1c.R.WriteTo(w)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	n, err = r1c.O.WriteTo(w)
+	total += n
+	return total, err
+}
+
+// ReadFrom reads an R1C previously written by WriteTo.
+func (r1c *R1C) ReadFrom(r io.Reader) (int64, error) {
+	br := asReaderByteReader(r)
+	total, err := r1c.L.ReadFrom(br)
+	if err != nil {
+		return total, err
+	}
+	n, err := r1c.R.ReadFrom(br)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	n, err = r1c.O.ReadFrom(br)
+	total += n
+	return total, err
+}
+
+// MarshalBinary returns r1c prefixed with the stream header. Coefficients
+// are NOT embedded: a CoeffID is only meaningful against the exact same
+// []big.Int table, in the exact same order, that was in effect when r1c
+// was produced — exactly as R1C.String already requires, and just as
+// fragile across gnark versions that reorder or prune that table. Prefer
+// R1CSWriter/R1CSReader, which persist the coefficient table alongside the
+// records that index into it.
+func (r1c *R1C) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		return nil, err
+	}
+	if _, err := r1c.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary reconstructs r1c from a payload written by MarshalBinary.
+func (r1c *R1C) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := checkHeader(r); err != nil {
+		return err
+	}
+	_, err := r1c.ReadFrom(r)
+	return err
+}
+
+// WriteTo writes h.WireID and h.ID as varints, followed by h.Inputs encoded
+// the same way as a slice of LinearExpression in LinearExpression.WriteTo.
+func (h *Hint) WriteTo(w io.Writer) (int64, error) {
+	var scratch [binary.MaxVarintLen64]byte
+	total, err := writeUvarint(w, scratch[:], uint64(h.WireID))
+	if err != nil {
+		return total, err
+	}
+	n, err := writeUvarint(w, scratch[:], uint64(h.ID))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	n, err = writeUvarint(w, scratch[:], uint64(len(h.Inputs)))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	for i := range h.Inputs {
+		n, err := h.Inputs[i].WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom reads a Hint previously written by WriteTo.
+func (h *Hint) ReadFrom(r io.Reader) (int64, error) {
+	br := asReaderByteReader(r)
+	wireID, total, err := readUvarint(br)
+	if err != nil {
+		return total, err
+	}
+	id, n, err := readUvarint(br)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	count, n, err := readUvarint(br)
+	total += n
+	if err != nil {
+		return total, err
+	}
+	if err := checkDecodeLen(count); err != nil {
+		return total, err
+	}
+	inputs := make([]LinearExpression, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var le LinearExpression
+		n, err := le.ReadFrom(br)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		inputs = append(inputs, le)
+	}
+	h.WireID = int(wireID)
+	h.ID = hint.ID(id)
+	h.Inputs = inputs
+	return total, nil
+}
+
+// MarshalBinary returns h prefixed with the stream header.
+func (h *Hint) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		return nil, err
+	}
+	if _, err := h.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary reconstructs h from a payload written by MarshalBinary.
+func (h *Hint) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := checkHeader(r); err != nil {
+		return err
+	}
+	_, err := h.ReadFrom(r)
+	return err
+}
+
+// WriteTo writes e.Format as a varint length followed by its bytes, then
+// e.ToResolve as a varint count followed by each index as a varint.
+func (e *LogEntry) WriteTo(w io.Writer) (int64, error) {
+	var scratch [binary.MaxVarintLen64]byte
+	total, err := writeUvarint(w, scratch[:], uint64(len(e.Format)))
+	if err != nil {
+		return total, err
+	}
+	n, err := w.Write([]byte(e.Format))
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+	n2, err := writeUvarint(w, scratch[:], uint64(len(e.ToResolve)))
+	total += n2
+	if err != nil {
+		return total, err
+	}
+	for _, v := range e.ToResolve {
+		n, err := writeUvarint(w, scratch[:], uint64(v))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom reads a LogEntry previously written by WriteTo.
+func (e *LogEntry) ReadFrom(r io.Reader) (int64, error) {
+	br := asReaderByteReader(r)
+	flen, total, err := readUvarint(br)
+	if err != nil {
+		return total, err
+	}
+	if err := checkDecodeLen(flen); err != nil {
+		return total, err
+	}
+	format := make([]byte, flen)
+	n, err := io.ReadFull(br, format)
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+	count, n64, err := readUvarint(br)
+	total += n64
+	if err != nil {
+		return total, err
+	}
+	if err := checkDecodeLen(count); err != nil {
+		return total, err
+	}
+	toResolve := make([]int, 0, count)
+	for i := uint64(0); i < count; i++ {
+		v, n, err := readUvarint(br)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		toResolve = append(toResolve, int(v))
+	}
+	e.Format = string(format)
+	e.ToResolve = toResolve
+	return total, nil
+}
+
+// MarshalBinary returns e prefixed with the stream header.
+func (e *LogEntry) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		return nil, err
+	}
+	if _, err := e.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary reconstructs e from a payload written by MarshalBinary.
+func (e *LogEntry) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := checkHeader(r); err != nil {
+		return err
+	}
+	_, err := e.ReadFrom(r)
+	return err
+}
@@ -0,0 +1,337 @@
+// Copyright 2020 ConsenSys AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compiled
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark/backend/hint"
+)
+
+func TestTermRoundTrip(t *testing.T) {
+	term := Pack(42, 7, Secret)
+
+	var buf bytes.Buffer
+	if _, err := term.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Term
+	if _, err := got.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got != term {
+		t.Fatalf("got %v, want %v", got, term)
+	}
+}
+
+// TestTermRoundTripAllVisibilities stresses the bit packing in
+// Term.WriteTo/ReadFrom across every Visibility value and a large
+// VariableID/CoeffID, since WriteTo/ReadFrom round-trip only whatever
+// Unpack/Pack expose: if Term ever carries state beyond CoeffID,
+// VariableID and Visibility, this codec needs to be extended to cover it.
+func TestTermRoundTripAllVisibilities(t *testing.T) {
+	visibilities := []Visibility{Unset, Internal, Secret, Public, Virtual}
+	for _, vis := range visibilities {
+		term := Pack(1<<20, 1<<20, vis)
+
+		var buf bytes.Buffer
+		if _, err := term.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var got Term
+		if _, err := got.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if got != term {
+			t.Fatalf("visibility %v: got %v, want %v", vis, got, term)
+		}
+	}
+}
+
+func TestLinearExpressionMarshalRoundTrip(t *testing.T) {
+	cases := []LinearExpression{
+		{},
+		{Pack(0, 0, Internal)},
+		{Pack(1, 0, Public), Pack(2, 1, Secret), Pack(3, 0, Virtual)},
+	}
+
+	for _, l := range cases {
+		data, err := l.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got LinearExpression
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !got.equalIDs(l) {
+			t.Fatalf("got %v, want %v", got, l)
+		}
+	}
+}
+
+func TestR1CMarshalRoundTrip(t *testing.T) {
+	r1c := R1C{
+		L: LinearExpression{Pack(0, 0, Internal)},
+		R: LinearExpression{Pack(1, 1, Secret)},
+		O: LinearExpression{},
+	}
+
+	data, err := r1c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got R1C
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !got.L.equalIDs(r1c.L) || !got.R.equalIDs(r1c.R) || !got.O.equalIDs(r1c.O) {
+		t.Fatalf("got %+v, want %+v", got, r1c)
+	}
+}
+
+func TestHintMarshalRoundTrip(t *testing.T) {
+	h := Hint{
+		WireID: 5,
+		ID:     hint.ID(17),
+		Inputs: []LinearExpression{
+			{Pack(0, 0, Internal), Pack(1, 0, Internal)},
+			{},
+		},
+	}
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Hint
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.WireID != h.WireID || got.ID != h.ID || len(got.Inputs) != len(h.Inputs) {
+		t.Fatalf("got %+v, want %+v", got, h)
+	}
+	for i := range h.Inputs {
+		if !got.Inputs[i].equalIDs(h.Inputs[i]) {
+			t.Fatalf("input %d: got %v, want %v", i, got.Inputs[i], h.Inputs[i])
+		}
+	}
+}
+
+func TestLogEntryMarshalRoundTrip(t *testing.T) {
+	e := LogEntry{Format: "x = %d", ToResolve: []int{0, 3, 9}}
+
+	data, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got LogEntry
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Format != e.Format || len(got.ToResolve) != len(e.ToResolve) {
+		t.Fatalf("got %+v, want %+v", got, e)
+	}
+	for i := range e.ToResolve {
+		if got.ToResolve[i] != e.ToResolve[i] {
+			t.Fatalf("got %v, want %v", got.ToResolve, e.ToResolve)
+		}
+	}
+}
+
+func TestUnmarshalBinaryRejectsBadMagic(t *testing.T) {
+	var l LinearExpression
+	err := l.UnmarshalBinary([]byte{'b', 'a', 'd', '!', 1, 0})
+	if err == nil {
+		t.Fatal("expected an error for bad magic, got nil")
+	}
+}
+
+func TestUnmarshalBinaryRejectsNewerSchema(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(r1csMagic[:])
+	buf.Write([]byte{0xff, 0xff}) // schema version far beyond what this build supports
+
+	var l LinearExpression
+	err := l.UnmarshalBinary(buf.Bytes())
+	if !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("got %v, want ErrUnsupportedSchema", err)
+	}
+}
+
+func TestUnmarshalBinaryRejectsGarbageLength(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], 1<<40) // a corrupt/truncated file could claim billions of terms
+	buf.Write(scratch[:n])
+
+	var l LinearExpression
+	if err := l.UnmarshalBinary(buf.Bytes()); err == nil {
+		t.Fatal("expected an error for a garbage length, got nil")
+	}
+}
+
+func TestR1CSReaderRejectsGarbageDictEntry(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := writeHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteByte(tagCoeffDict)
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], 1<<40) // a corrupt coefficient ID
+	buf.Write(scratch[:n])
+
+	dec, err := NewR1CSReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Next(); err == nil {
+		t.Fatal("expected an error for a garbage dictionary entry id, got nil")
+	}
+}
+
+// equalIDs compares LinearExpressions term for term without looking at a
+// coefficient table, which is all these round-trip tests need: the decoded
+// Term must carry the exact same CoeffID/VariableID/Visibility as before.
+func (l LinearExpression) equalIDs(other LinearExpression) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for i := range l {
+		if l[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestR1CSWriterReaderRoundTrip(t *testing.T) {
+	coeffs := []big.Int{*big.NewInt(1), *big.NewInt(-7), *big.NewInt(0)}
+
+	r1cA := R1C{
+		L: LinearExpression{Pack(0, 0, Internal)},
+		R: LinearExpression{Pack(1, 1, Secret)},
+		O: LinearExpression{Pack(2, 2, Public)},
+	}
+	r1cB := R1C{
+		L: LinearExpression{Pack(3, 1, Internal)}, // shares CoeffID 1 with r1cA.R
+		R: LinearExpression{Pack(4, 0, Secret)},
+		O: LinearExpression{},
+	}
+
+	var buf bytes.Buffer
+	enc := NewR1CSWriter(&buf, coeffs)
+	if _, err := enc.EncodeR1C(r1cA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.EncodeR1C(r1cB); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewR1CSReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []R1C
+	for {
+		rec, err := dec.Next()
+		if err != nil {
+			break
+		}
+		r1c, ok := rec.(*R1C)
+		if !ok {
+			t.Fatalf("unexpected record type %T", rec)
+		}
+		got = append(got, *r1c)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d records, want 2", len(got))
+	}
+	if !got[0].L.equalIDs(r1cA.L) || !got[0].R.equalIDs(r1cA.R) || !got[0].O.equalIDs(r1cA.O) {
+		t.Fatalf("record 0: got %+v, want %+v", got[0], r1cA)
+	}
+	if !got[1].L.equalIDs(r1cB.L) || !got[1].R.equalIDs(r1cB.R) || !got[1].O.equalIDs(r1cB.O) {
+		t.Fatalf("record 1: got %+v, want %+v", got[1], r1cB)
+	}
+	for id, c := range coeffs {
+		if dec.Coeffs[id].Cmp(&c) != 0 {
+			t.Fatalf("coeff %d: got %s, want %s", id, dec.Coeffs[id].String(), c.String())
+		}
+	}
+}
+
+func TestR1CSWriterAppendSharesDictionary(t *testing.T) {
+	coeffs := []big.Int{*big.NewInt(3), *big.NewInt(5)}
+	r1c := R1C{
+		L: LinearExpression{Pack(0, 0, Internal)},
+		R: LinearExpression{Pack(1, 1, Secret)},
+		O: LinearExpression{},
+	}
+
+	var buf bytes.Buffer
+	enc := NewR1CSWriter(&buf, coeffs)
+	if _, err := enc.EncodeR1C(r1c); err != nil {
+		t.Fatal(err)
+	}
+	sent := enc.SentCoeffIDs()
+	firstLen := buf.Len()
+
+	appendEnc := NewAppendingR1CSWriter(&buf, coeffs, sent)
+	if _, err := appendEnc.EncodeR1C(r1c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-encoding the exact same R1C via NewAppendingR1CSWriter must not
+	// repeat the header or the dictionary entries, so it should cost fewer
+	// bytes than encoding it from scratch (which pays for both).
+	var fresh bytes.Buffer
+	freshEnc := NewR1CSWriter(&fresh, coeffs)
+	if _, err := freshEnc.EncodeR1C(r1c); err != nil {
+		t.Fatal(err)
+	}
+	appended := buf.Len() - firstLen
+	if appended >= fresh.Len() {
+		t.Fatalf("appended %d bytes, expected fewer than a from-scratch encode (%d bytes)", appended, fresh.Len())
+	}
+
+	dec, err := NewR1CSReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for {
+		rec, err := dec.Next()
+		if err != nil {
+			break
+		}
+		if _, ok := rec.(*R1C); !ok {
+			t.Fatalf("unexpected record type %T", rec)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("got %d records, want 2", count)
+	}
+}
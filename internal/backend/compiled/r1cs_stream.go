@@ -0,0 +1,266 @@
+// Copyright 2020 ConsenSys AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compiled
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Record tags identify what follows in an R1CSWriter/R1CSReader stream.
+const (
+	tagCoeffDict byte = iota
+	tagR1C
+	tagHint
+)
+
+// R1CSWriter streams R1C and Hint records to w, sharing a single
+// dictionary-compressed coefficient table across all of them: a given
+// CoeffID's big.Int value is written at most once, however many terms
+// reference it.
+type R1CSWriter struct {
+	w           io.Writer
+	coeffs      []big.Int
+	sent        map[int]struct{}
+	scratch     [binary.MaxVarintLen64]byte
+	wroteHeader bool
+}
+
+// NewR1CSWriter returns a writer that encodes records against coeffs; every
+// CoeffID referenced by an encoded record must be a valid index into it.
+func NewR1CSWriter(w io.Writer, coeffs []big.Int) *R1CSWriter {
+	return &R1CSWriter{w: w, coeffs: coeffs, sent: make(map[int]struct{})}
+}
+
+// NewAppendingR1CSWriter returns a R1CSWriter for w assuming the header and
+// the dictionary entries in alreadySent were already written in a previous
+// session, so they are not re-emitted.
+func NewAppendingR1CSWriter(w io.Writer, coeffs []big.Int, alreadySent []int) *R1CSWriter {
+	enc := NewR1CSWriter(w, coeffs)
+	enc.wroteHeader = true
+	for _, id := range alreadySent {
+		enc.sent[id] = struct{}{}
+	}
+	return enc
+}
+
+func (enc *R1CSWriter) ensureHeader() (int64, error) {
+	if enc.wroteHeader {
+		return 0, nil
+	}
+	enc.wroteHeader = true
+	return writeHeader(enc.w)
+}
+
+func collectCoeffIDs(terms ...LinearExpression) []int {
+	var ids []int
+	for _, le := range terms {
+		for _, t := range le {
+			ids = append(ids, t.CoeffID())
+		}
+	}
+	return ids
+}
+
+func (enc *R1CSWriter) writeDictEntries(coeffIDs []int) (int64, error) {
+	var total int64
+	for _, id := range coeffIDs {
+		if _, ok := enc.sent[id]; ok {
+			continue
+		}
+		enc.sent[id] = struct{}{}
+
+		if _, err := enc.w.Write([]byte{tagCoeffDict}); err != nil {
+			return total, err
+		}
+		total++
+
+		n, err := writeUvarint(enc.w, enc.scratch[:], uint64(id))
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		sign := byte(0)
+		if enc.coeffs[id].Sign() < 0 {
+			sign = 1
+		}
+		if _, err := enc.w.Write([]byte{sign}); err != nil {
+			return total, err
+		}
+		total++
+
+		b := enc.coeffs[id].Bytes()
+		n, err = writeUvarint(enc.w, enc.scratch[:], uint64(len(b)))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		nn, err := enc.w.Write(b)
+		total += int64(nn)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// EncodeR1C appends r1c to the stream, first flushing any coefficients it
+// references that haven't been sent yet.
+func (enc *R1CSWriter) EncodeR1C(r1c R1C) (int64, error) {
+	total, err := enc.ensureHeader()
+	if err != nil {
+		return total, err
+	}
+	n, err := enc.writeDictEntries(collectCoeffIDs(r1c.L, r1c.R, r1c.O))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	if _, err := enc.w.Write([]byte{tagR1C}); err != nil {
+		return total, err
+	}
+	total++
+	n, err = r1c.WriteTo(enc.w)
+	total += n
+	return total, err
+}
+
+// EncodeHint appends h to the stream, the same way EncodeR1C does for an
+// R1C.
+func (enc *R1CSWriter) EncodeHint(h Hint) (int64, error) {
+	total, err := enc.ensureHeader()
+	if err != nil {
+		return total, err
+	}
+	n, err := enc.writeDictEntries(collectCoeffIDs(h.Inputs...))
+	total += n
+	if err != nil {
+		return total, err
+	}
+	if _, err := enc.w.Write([]byte{tagHint}); err != nil {
+		return total, err
+	}
+	total++
+	n, err = h.WriteTo(enc.w)
+	total += n
+	return total, err
+}
+
+// SentCoeffIDs returns the CoeffIDs already flushed to the stream, in the
+// form NewAppendingR1CSWriter expects.
+func (enc *R1CSWriter) SentCoeffIDs() []int {
+	ids := make([]int, 0, len(enc.sent))
+	for id := range enc.sent {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// R1CSReader is the counterpart to R1CSWriter: it decodes dictionary
+// entries as they are encountered, growing Coeffs to hold them.
+type R1CSReader struct {
+	r      readerByteReader
+	Coeffs []big.Int
+}
+
+// NewR1CSReader validates the stream header and returns a reader positioned
+// at the first record.
+func NewR1CSReader(r io.Reader) (*R1CSReader, error) {
+	br := asReaderByteReader(r)
+	if _, err := checkHeader(br); err != nil {
+		return nil, err
+	}
+	return &R1CSReader{r: br}, nil
+}
+
+func (dec *R1CSReader) growCoeffs(id int) {
+	if id < len(dec.Coeffs) {
+		return
+	}
+	grown := make([]big.Int, id+1)
+	copy(grown, dec.Coeffs)
+	dec.Coeffs = grown
+}
+
+func (dec *R1CSReader) readDictEntry() error {
+	id64, _, err := readUvarint(dec.r)
+	if err != nil {
+		return err
+	}
+	if err := checkDecodeLen(id64); err != nil {
+		return err
+	}
+	sign, err := dec.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	blen, _, err := readUvarint(dec.r)
+	if err != nil {
+		return err
+	}
+	if err := checkDecodeLen(blen); err != nil {
+		return err
+	}
+	buf := make([]byte, blen)
+	if _, err := io.ReadFull(dec.r, buf); err != nil {
+		return err
+	}
+
+	var v big.Int
+	v.SetBytes(buf)
+	if sign == 1 {
+		v.Neg(&v)
+	}
+
+	id := int(id64)
+	dec.growCoeffs(id)
+	dec.Coeffs[id] = v
+	return nil
+}
+
+// Next decodes the next record in the stream, consuming and applying any
+// coefficient dictionary entries that precede it, and returns it as either
+// an *R1C or a *Hint. It returns io.EOF once the stream is exhausted.
+func (dec *R1CSReader) Next() (interface{}, error) {
+	for {
+		tag, err := dec.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagCoeffDict:
+			if err := dec.readDictEntry(); err != nil {
+				return nil, err
+			}
+		case tagR1C:
+			var r1c R1C
+			if _, err := r1c.ReadFrom(dec.r); err != nil {
+				return nil, err
+			}
+			return &r1c, nil
+		case tagHint:
+			var h Hint
+			if _, err := h.ReadFrom(dec.r); err != nil {
+				return nil, err
+			}
+			return &h, nil
+		default:
+			return nil, fmt.Errorf("compiled: unknown record tag %d", tag)
+		}
+	}
+}